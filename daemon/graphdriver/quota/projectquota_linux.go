@@ -0,0 +1,449 @@
+// +build linux
+
+// Package quota provides a generic quota setter/getter interface, along
+// with a specific implementation for filesystems with project quota
+// support.
+//
+// Currently, the filesystems supported are those where the quota can be
+// controlled using the standard Linux "quotactl" syscall: XFS, and ext4
+// filesystems mounted with project quota enabled (kernel >= 4.5). The two
+// don't share a quotactl command family: XFS uses its own Q_XGETQUOTA/
+// Q_XSETQLIM-style ("X") commands, while ext4's support goes through the
+// generic VFS quota commands (Q_GETQUOTA/Q_SETQUOTA); both are handled
+// per-backend below, alongside how a directory gets stamped with its
+// project id.
+//
+// The quota entities here are referred to as "projects"; they map onto
+// the FS_PROJ_QUOTA / PRJQUOTA quotactl mechanism.
+package quota
+
+/*
+#include <stdlib.h>
+#include <dirent.h>
+#include <linux/fs.h>
+#include <linux/quota.h>
+#include <linux/dqblk_xfs.h>
+
+#ifndef FS_XFLAG_PROJINHERIT
+struct fsxattr {
+	__u32		fsx_xflags;
+	__u32		fsx_extsize;
+	__u32		fsx_nextents;
+	__u32		fsx_projid;
+	unsigned char	fsx_pad[12];
+};
+#define FS_XFLAG_PROJINHERIT	0x00000200
+#endif
+#ifndef FS_IOC_FSGETXATTR
+#define FS_IOC_FSGETXATTR		_IOR('X', 31, struct fsxattr)
+#endif
+#ifndef FS_IOC_FSSETXATTR
+#define FS_IOC_FSSETXATTR		_IOW('X', 32, struct fsxattr)
+#endif
+
+#ifndef PRJQUOTA
+#define PRJQUOTA	2
+#endif
+#ifndef FS_PROJ_QUOTA
+#define FS_PROJ_QUOTA 2
+#endif
+#ifndef Q_XGETPQUOTA
+#define Q_XGETPQUOTA QCMD(Q_XGETQUOTA, PRJQUOTA)
+#endif
+#ifndef Q_XSETPQLIM
+#define Q_XSETPQLIM QCMD(Q_XSETQLIM, PRJQUOTA)
+#endif
+#ifndef Q_XGETQSTAT_PRJQUOTA
+#define Q_XGETQSTAT_PRJQUOTA QCMD(Q_XGETQSTAT, PRJQUOTA)
+#endif
+
+// ext4 has no XFS-style quotactl command family: Q_XGET*QUOTA and
+// Q_XSET*QLIM (the "X" commands, XQM_CMD-encoded in dqblk_xfs.h) are
+// dispatched only by XFS's own quotactl ops. ext4's project quota support
+// (kernel >= 4.5) goes through the generic VFS quota commands instead,
+// which take an id argument and a struct if_dqblk/if_nextdqblk rather
+// than fs_disk_quota_t.
+#ifndef Q_GETNEXTQUOTA
+#define Q_GETNEXTQUOTA 0x800009
+struct if_nextdqblk {
+	__u64 dqb_bhardlimit;
+	__u64 dqb_bsoftlimit;
+	__u64 dqb_curspace;
+	__u64 dqb_ihardlimit;
+	__u64 dqb_isoftlimit;
+	__u64 dqb_curinodes;
+	__u64 dqb_btime;
+	__u64 dqb_itime;
+	__u32 dqb_valid;
+	__u32 dqb_id;
+};
+#endif
+#ifndef Q_EXT4GETQUOTA
+#define Q_EXT4GETQUOTA QCMD(Q_GETQUOTA, PRJQUOTA)
+#endif
+#ifndef Q_EXT4SETQUOTA
+#define Q_EXT4SETQUOTA QCMD(Q_SETQUOTA, PRJQUOTA)
+#endif
+#ifndef Q_EXT4GETNEXTQUOTA
+#define Q_EXT4GETNEXTQUOTA QCMD(Q_GETNEXTQUOTA, PRJQUOTA)
+#endif
+*/
+import "C"
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Quota limit params - currently we only control blocks hard limit
+type Quota struct {
+	Size uint64
+}
+
+// Control is the context used by storage drivers (e.g. overlay2) that
+// want to apply project quotas to container directories. It is bound to a
+// single filesystem, identified by its backing block device, and hands
+// out project ids from an internal counter.
+type Control struct {
+	backingFsBlockDev string
+	backingFsType     backingFsType
+	nextProjectID     uint32
+	quotas            map[string]uint32
+}
+
+// backingFsType identifies which project-quota mechanism a Control talks
+// to. XFS and ext4 take different quotactl(2) commands for getting and
+// setting limits, but stamp a directory with its project id the same way.
+type backingFsType int
+
+const (
+	backingFsUnsupported backingFsType = iota
+	backingFsXFS
+	backingFsExt4
+)
+
+// ErrQuotaNotSupported is returned when a project quota can't be
+// established because the backing filesystem isn't XFS or ext4, or
+// doesn't have project quotas enabled.
+var ErrQuotaNotSupported = fmt.Errorf("filesystem does not support, or has not enabled quotas")
+
+// NewControl initializes project quota support for the filesystem that
+// hosts basePath, returning ErrQuotaNotSupported if that filesystem isn't
+// XFS or ext4-with-project-quotas. It also scans basePath's immediate
+// children for project ids already stamped on disk, so that ids handed
+// out after a daemon restart don't collide with ones already in use.
+func NewControl(basePath string) (*Control, error) {
+	fsType, err := detectBackingFsType(basePath)
+	if err != nil {
+		return nil, err
+	}
+	if fsType == backingFsUnsupported {
+		return nil, ErrQuotaNotSupported
+	}
+
+	backingFsBlockDev, err := MakeBackingFsDev(basePath)
+	if err != nil {
+		return nil, err
+	}
+
+	hasSupport, err := hasQuotaSupport(fsType, backingFsBlockDev)
+	if err != nil {
+		return nil, err
+	}
+	if !hasSupport {
+		return nil, ErrQuotaNotSupported
+	}
+
+	q := &Control{
+		backingFsBlockDev: backingFsBlockDev,
+		backingFsType:     fsType,
+		quotas:            make(map[string]uint32),
+	}
+
+	nextProjectID, err := q.findNextProjectID(basePath)
+	if err != nil {
+		return nil, err
+	}
+	q.nextProjectID = nextProjectID
+
+	return q, nil
+}
+
+// SetQuota sets the size limit for the directory identified by
+// targetPath, assigning it a fresh project id (and marking it
+// PROJINHERIT, so subdirectories created later inherit it) the first
+// time it's seen.
+func (q *Control) SetQuota(targetPath string, quota Quota) error {
+	projectID, ok := q.quotas[targetPath]
+	if !ok {
+		projectID = q.nextProjectID
+
+		if err := q.setProjectID(targetPath, projectID); err != nil {
+			return err
+		}
+
+		q.quotas[targetPath] = projectID
+		q.nextProjectID++
+	}
+
+	return q.setProjectQuota(projectID, quota)
+}
+
+// extQuotaBlockSize is the block unit the generic VFS quota ioctls
+// (Q_GETQUOTA/Q_SETQUOTA, used by ext4) count in. It's fixed at 1KiB by
+// the kernel's quota core, unlike XFS's fs_disk_quota_t, which counts in
+// 512-byte "basic blocks".
+const extQuotaBlockSize = 1024
+
+func (q *Control) setProjectQuota(projectID uint32, quota Quota) error {
+	if q.backingFsType == backingFsExt4 {
+		return q.setExt4ProjectQuota(projectID, quota)
+	}
+	return q.setXFSProjectQuota(projectID, quota)
+}
+
+func (q *Control) setXFSProjectQuota(projectID uint32, quota Quota) error {
+	var d C.fs_disk_quota_t
+	d.d_version = C.FS_DQUOT_VERSION
+	d.d_id = C.__u32(projectID)
+	d.d_flags = C.FS_PROJ_QUOTA
+
+	d.d_fieldmask = C.FS_DQ_BHARD | C.FS_DQ_BSOFT
+	d.d_blk_hardlimit = C.__u64(quota.Size / 512)
+	d.d_blk_softlimit = d.d_blk_hardlimit
+
+	cs := C.CString(q.backingFsBlockDev)
+	defer C.free(unsafe.Pointer(cs))
+
+	_, _, errno := unix.Syscall6(unix.SYS_QUOTACTL, C.Q_XSETPQLIM,
+		uintptr(unsafe.Pointer(cs)), uintptr(d.d_id),
+		uintptr(unsafe.Pointer(&d)), 0, 0)
+	if errno != 0 {
+		return fmt.Errorf("failed to set quota limit for project id %d on %s: %v",
+			projectID, q.backingFsBlockDev, errno.Error())
+	}
+
+	return nil
+}
+
+func (q *Control) setExt4ProjectQuota(projectID uint32, quota Quota) error {
+	var d C.struct_if_dqblk
+	d.dqb_bhardlimit = C.__u64(quota.Size / extQuotaBlockSize)
+	d.dqb_bsoftlimit = d.dqb_bhardlimit
+	d.dqb_valid = C.QIF_BLIMITS
+
+	cs := C.CString(q.backingFsBlockDev)
+	defer C.free(unsafe.Pointer(cs))
+
+	_, _, errno := unix.Syscall6(unix.SYS_QUOTACTL, C.Q_EXT4SETQUOTA,
+		uintptr(unsafe.Pointer(cs)), uintptr(C.__u32(projectID)),
+		uintptr(unsafe.Pointer(&d)), 0, 0)
+	if errno != 0 {
+		return fmt.Errorf("failed to set quota limit for project id %d on %s: %v",
+			projectID, q.backingFsBlockDev, errno.Error())
+	}
+
+	return nil
+}
+
+// GetQuota reports the currently set size limit for the directory
+// identified by targetPath.
+func (q *Control) GetQuota(targetPath string, quota *Quota) error {
+	projectID, ok := q.quotas[targetPath]
+	if !ok {
+		return fmt.Errorf("quota not found for path : %s", targetPath)
+	}
+
+	if q.backingFsType == backingFsExt4 {
+		return q.getExt4Quota(projectID, quota)
+	}
+	return q.getXFSQuota(projectID, quota)
+}
+
+func (q *Control) getXFSQuota(projectID uint32, quota *Quota) error {
+	var d C.fs_disk_quota_t
+
+	cs := C.CString(q.backingFsBlockDev)
+	defer C.free(unsafe.Pointer(cs))
+
+	_, _, errno := unix.Syscall6(unix.SYS_QUOTACTL, C.Q_XGETPQUOTA,
+		uintptr(unsafe.Pointer(cs)), uintptr(C.__u32(projectID)),
+		uintptr(unsafe.Pointer(&d)), 0, 0)
+	if errno != 0 {
+		return fmt.Errorf("failed to get quota limit for project id %d on %s: %v",
+			projectID, q.backingFsBlockDev, errno.Error())
+	}
+	quota.Size = uint64(d.d_blk_hardlimit) * 512
+
+	return nil
+}
+
+func (q *Control) getExt4Quota(projectID uint32, quota *Quota) error {
+	var d C.struct_if_dqblk
+
+	cs := C.CString(q.backingFsBlockDev)
+	defer C.free(unsafe.Pointer(cs))
+
+	_, _, errno := unix.Syscall6(unix.SYS_QUOTACTL, C.Q_EXT4GETQUOTA,
+		uintptr(unsafe.Pointer(cs)), uintptr(C.__u32(projectID)),
+		uintptr(unsafe.Pointer(&d)), 0, 0)
+	if errno != 0 {
+		return fmt.Errorf("failed to get quota limit for project id %d on %s: %v",
+			projectID, q.backingFsBlockDev, errno.Error())
+	}
+	quota.Size = uint64(d.dqb_bhardlimit) * extQuotaBlockSize
+
+	return nil
+}
+
+// setProjectID stamps targetPath with projectID via FS_IOC_FSSETXATTR and
+// sets the inherit flag so newly created children keep it. This ioctl
+// works the same way on both XFS and ext4.
+func (q *Control) setProjectID(targetPath string, projectID uint32) error {
+	dir, err := unix.Open(targetPath, unix.O_RDONLY|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(dir)
+
+	var fsx C.struct_fsxattr
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(dir),
+		C.FS_IOC_FSGETXATTR, uintptr(unsafe.Pointer(&fsx))); errno != 0 {
+		return fmt.Errorf("failed to get xattr flags for %s: %v", targetPath, errno.Error())
+	}
+	fsx.fsx_projid = C.__u32(projectID)
+	fsx.fsx_xflags |= C.FS_XFLAG_PROJINHERIT
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(dir),
+		C.FS_IOC_FSSETXATTR, uintptr(unsafe.Pointer(&fsx))); errno != 0 {
+		return fmt.Errorf("failed to set project id for %s: %v", targetPath, errno.Error())
+	}
+
+	return nil
+}
+
+// getProjectID reads back the project id previously stamped on
+// targetPath via setProjectID, or 0 if none has been set.
+func (q *Control) getProjectID(targetPath string) (uint32, error) {
+	dir, err := unix.Open(targetPath, unix.O_RDONLY|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer unix.Close(dir)
+
+	var fsx C.struct_fsxattr
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(dir),
+		C.FS_IOC_FSGETXATTR, uintptr(unsafe.Pointer(&fsx))); errno != 0 {
+		return 0, fmt.Errorf("failed to get xattr flags for %s: %v", targetPath, errno.Error())
+	}
+
+	return uint32(fsx.fsx_projid), nil
+}
+
+// findNextProjectID scans the immediate children of basePath, records any
+// project id already stamped on them, and returns the next unused id.
+func (q *Control) findNextProjectID(basePath string) (uint32, error) {
+	files, err := ioutil.ReadDir(basePath)
+	if err != nil {
+		return 0, err
+	}
+
+	nextProjectID := uint32(1)
+	for _, file := range files {
+		if !file.IsDir() {
+			continue
+		}
+
+		path := filepath.Join(basePath, file.Name())
+		projectID, err := q.getProjectID(path)
+		if err != nil {
+			return 0, err
+		}
+		if projectID == 0 {
+			continue
+		}
+		q.quotas[path] = projectID
+		if projectID >= nextProjectID {
+			nextProjectID = projectID + 1
+		}
+	}
+
+	return nextProjectID, nil
+}
+
+// hasQuotaSupport probes the backing device for project-quota accounting,
+// using the command family that matches fsType: XFS reports this
+// directly via Q_XGETQSTAT_PRJQUOTA; ext4 has no equivalent stat call, so
+// we fall back to asking for the next quota record with the generic
+// Q_EXT4GETNEXTQUOTA command, which succeeds only when the filesystem is
+// actually accounting project quotas.
+func hasQuotaSupport(fsType backingFsType, backingFsBlockDev string) (bool, error) {
+	if fsType == backingFsExt4 {
+		return hasExt4QuotaSupport(backingFsBlockDev)
+	}
+	return hasXFSQuotaSupport(backingFsBlockDev)
+}
+
+func hasXFSQuotaSupport(backingFsBlockDev string) (bool, error) {
+	cs := C.CString(backingFsBlockDev)
+	defer C.free(unsafe.Pointer(cs))
+
+	var qstat C.fs_quota_stat_t
+	_, _, errno := unix.Syscall6(unix.SYS_QUOTACTL, C.Q_XGETQSTAT_PRJQUOTA,
+		uintptr(unsafe.Pointer(cs)), 0, uintptr(unsafe.Pointer(&qstat)), 0, 0)
+	return errno == 0 && qstat.qs_flags&C.FS_QUOTA_PDQ_ENFD > 0 && qstat.qs_flags&C.FS_QUOTA_PDQ_ACCT > 0, nil
+}
+
+func hasExt4QuotaSupport(backingFsBlockDev string) (bool, error) {
+	cs := C.CString(backingFsBlockDev)
+	defer C.free(unsafe.Pointer(cs))
+
+	var next C.struct_if_nextdqblk
+	_, _, errno := unix.Syscall6(unix.SYS_QUOTACTL, C.Q_EXT4GETNEXTQUOTA,
+		uintptr(unsafe.Pointer(cs)), 0, uintptr(unsafe.Pointer(&next)), 0, 0)
+	return errno == 0, nil
+}
+
+// detectBackingFsType statfs's basePath and reports whether it lives on a
+// filesystem this package knows how to manage project quotas for.
+func detectBackingFsType(basePath string) (backingFsType, error) {
+	var buf unix.Statfs_t
+	if err := unix.Statfs(basePath, &buf); err != nil {
+		return backingFsUnsupported, fmt.Errorf("failed to statfs %q: %v", basePath, err)
+	}
+
+	switch buf.Type {
+	case unix.XFS_SUPER_MAGIC:
+		return backingFsXFS, nil
+	case unix.EXT4_SUPER_MAGIC:
+		return backingFsExt4, nil
+	default:
+		return backingFsUnsupported, nil
+	}
+}
+
+// MakeBackingFsDev creates a device node under basePath for the backing
+// filesystem's device, so quotactl (which takes a block device path, not
+// a mount point) has something stable to operate on: udev doesn't
+// guarantee a predictable path for every block device. It's exported so
+// that test scaffolding outside this package (see the quotatest
+// subpackage) can build its own fixtures around it.
+func MakeBackingFsDev(basePath string) (string, error) {
+	var stat syscall.Stat_t
+	if err := syscall.Stat(basePath, &stat); err != nil {
+		return "", err
+	}
+
+	backingFsBlockDev := filepath.Join(basePath, "backingFsBlockDev")
+	// Re-create the device node in case it was created with a different
+	// device major/minor by a previous, differently-configured run.
+	_ = unix.Unlink(backingFsBlockDev)
+	if err := unix.Mknod(backingFsBlockDev, unix.S_IFBLK|0600, int(stat.Dev)); err != nil {
+		return "", fmt.Errorf("failed to create backing device node at %s: %v", backingFsBlockDev, err)
+	}
+
+	return backingFsBlockDev, nil
+}
@@ -10,53 +10,68 @@ import (
 	"path/filepath"
 	"testing"
 
+	"github.com/docker/docker/daemon/graphdriver/quota/quotatest"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
-	"golang.org/x/sys/unix"
 )
 
 // 10MB
 const testQuotaSize = 10 * 1024 * 1024
-const imageSize = 64 * 1024 * 1024
 
 func TestBlockDev(t *testing.T) {
-	mkfs, err := exec.LookPath("mkfs.xfs")
-	if err != nil {
-		t.Fatal("mkfs.xfs not installed")
+	if reason, ok := quotatest.CanTestQuota(); !ok {
+		t.Skip(reason)
 	}
 
-	// create a sparse image
-	imageFile, err := ioutil.TempFile("", "xfs-image")
-	if err != nil {
-		t.Fatal(err)
-	}
-	imageFileName := imageFile.Name()
+	imageFileName, err := quotatest.PrepareQuotaTestImage(t)
+	require.NoError(t, err)
 	defer os.Remove(imageFileName)
-	if _, err = imageFile.Seek(imageSize-1, 0); err != nil {
-		t.Fatal(err)
-	}
-	if _, err = imageFile.Write([]byte{0}); err != nil {
-		t.Fatal(err)
-	}
-	if err = imageFile.Close(); err != nil {
-		t.Fatal(err)
-	}
 
-	// The reason for disabling these options is sometimes people run with a newer userspace
-	// than kernelspace
-	out, err := exec.Command(mkfs, "-m", "crc=0,finobt=0", imageFileName).CombinedOutput()
-	if len(out) > 0 {
-		t.Log(string(out))
-	}
-	if err != nil {
-		t.Fatal(err)
+	runTest(t, "testBlockDevQuotaDisabled", func(t *testing.T) {
+		quotatest.MountTest(t, imageFileName, false, testHasQuotaSupport(backingFsXFS, false))
+	})
+	runTest(t, "testBlockDevQuotaEnabled", func(t *testing.T) {
+		quotatest.MountTest(t, imageFileName, true, testHasQuotaSupport(backingFsXFS, true))
+	})
+	runTest(t, "testSmallerThanQuota", func(t *testing.T) {
+		quotatest.MountTest(t, imageFileName, true, wrapQuotaTest(testSmallerThanQuota))
+	})
+	runTest(t, "testBiggerThanQuota", func(t *testing.T) {
+		quotatest.MountTest(t, imageFileName, true, wrapQuotaTest(testBiggerThanQuota))
+	})
+	runTest(t, "testRetrieveQuota", func(t *testing.T) {
+		quotatest.MountTest(t, imageFileName, true, wrapQuotaTest(testRetrieveQuota))
+	})
+}
+
+// TestBlockDevExt4 exercises the same scenarios as TestBlockDev, but
+// against an ext4-with-project-quota image rather than xfs, so the ext4
+// backend added alongside XFS support is actually driven by a test
+// instead of only being reachable in production.
+func TestBlockDevExt4(t *testing.T) {
+	if reason, ok := quotatest.CanTestExt4Quota(); !ok {
+		t.Skip(reason)
 	}
 
-	runTest(t, "testBlockDevQuotaDisabled", wrapMountTest(imageFileName, false, testBlockDevQuotaDisabled))
-	runTest(t, "testBlockDevQuotaEnabled", wrapMountTest(imageFileName, true, testBlockDevQuotaEnabled))
-	runTest(t, "testSmallerThanQuota", wrapMountTest(imageFileName, true, wrapQuotaTest(testSmallerThanQuota)))
-	runTest(t, "testBiggerThanQuota", wrapMountTest(imageFileName, true, wrapQuotaTest(testBiggerThanQuota)))
-	runTest(t, "testRetrieveQuota", wrapMountTest(imageFileName, true, wrapQuotaTest(testRetrieveQuota)))
+	imageFileName, err := quotatest.PrepareExt4QuotaTestImage(t)
+	require.NoError(t, err)
+	defer os.Remove(imageFileName)
+
+	runTest(t, "testBlockDevQuotaDisabled", func(t *testing.T) {
+		quotatest.MountTest(t, imageFileName, false, testHasQuotaSupport(backingFsExt4, false))
+	})
+	runTest(t, "testBlockDevQuotaEnabled", func(t *testing.T) {
+		quotatest.MountTest(t, imageFileName, true, testHasQuotaSupport(backingFsExt4, true))
+	})
+	runTest(t, "testSmallerThanQuota", func(t *testing.T) {
+		quotatest.MountTest(t, imageFileName, true, wrapQuotaTest(testSmallerThanQuota))
+	})
+	runTest(t, "testBiggerThanQuota", func(t *testing.T) {
+		quotatest.MountTest(t, imageFileName, true, wrapQuotaTest(testBiggerThanQuota))
+	})
+	runTest(t, "testRetrieveQuota", func(t *testing.T) {
+		quotatest.MountTest(t, imageFileName, true, wrapQuotaTest(testRetrieveQuota))
+	})
 }
 
 func runTest(t *testing.T, testName string, testFunc func(*testing.T)) {
@@ -66,54 +81,14 @@ func runTest(t *testing.T, testName string, testFunc func(*testing.T)) {
 	}
 }
 
-func wrapMountTest(imageFileName string, enableQuota bool, testFunc func(t *testing.T, mountPoint, backingFsDev string)) func(*testing.T) {
-	return func(t *testing.T) {
-		mountOptions := "loop"
-
-		if enableQuota {
-			mountOptions = mountOptions + ",prjquota"
-		}
-
-		// create a mountPoint
-		mountPoint, err := ioutil.TempDir("", "xfs-mountPoint")
-		if err != nil {
-			t.Fatal(err)
-		}
-		defer os.RemoveAll(mountPoint)
-
-		out, err := exec.Command("mount", "-o", mountOptions, imageFileName, mountPoint).CombinedOutput()
-		if len(out) > 0 {
-			t.Log(string(out))
-		}
-		if err != nil {
-			t.Fatal("mount failed")
-		}
-
-		defer func() {
-			if err := unix.Unmount(mountPoint, 0); err != nil {
-				t.Fatal(err)
-			}
-		}()
-
-		backingFsDev, err := makeBackingFsDev(mountPoint)
+func testHasQuotaSupport(fsType backingFsType, want bool) func(t *testing.T, mountPoint, backingFsDev string) {
+	return func(t *testing.T, mountPoint, backingFsDev string) {
+		hasSupport, err := hasQuotaSupport(fsType, backingFsDev)
 		require.NoError(t, err)
-
-		testFunc(t, mountPoint, backingFsDev)
+		assert.Equal(t, want, hasSupport)
 	}
 }
 
-func testBlockDevQuotaDisabled(t *testing.T, mountPoint, backingFsDev string) {
-	hasSupport, err := hasQuotaSupport(backingFsDev)
-	require.NoError(t, err)
-	assert.False(t, hasSupport)
-}
-
-func testBlockDevQuotaEnabled(t *testing.T, mountPoint, backingFsDev string) {
-	hasSupport, err := hasQuotaSupport(backingFsDev)
-	require.NoError(t, err)
-	assert.True(t, hasSupport)
-}
-
 func wrapQuotaTest(testFunc func(t *testing.T, ctrl *Control, mountPoint, testDir, testSubDir string)) func(t *testing.T, mountPoint, backingFsDev string) {
 	return func(t *testing.T, mountPoint, backingFsDev string) {
 		testDir, err := ioutil.TempDir(mountPoint, "per-test")
@@ -138,9 +113,12 @@ func testSmallerThanQuota(t *testing.T, ctrl *Control, homeDir, testDir, testSub
 }
 
 func testBiggerThanQuota(t *testing.T, ctrl *Control, homeDir, testDir, testSubDir string) {
-	// Make sure the quota is being enforced
-	// TODO: When we implement this under EXT4, we need to shed CAP_SYS_RESOURCE, otherwise id:91 gh:92
-	// we're able to violate quota without issue
+	// Make sure the quota is being enforced. On ext4, a process retaining
+	// CAP_SYS_RESOURCE can write past its project quota without error, so
+	// drop it before writing.
+	if ctrl.backingFsType == backingFsExt4 {
+		require.NoError(t, quotatest.DropCapSysResource())
+	}
 	require.NoError(t, ctrl.SetQuota(testSubDir, Quota{testQuotaSize}))
 
 	biggerThanQuotaFile := filepath.Join(testSubDir, "bigger-than-quota")
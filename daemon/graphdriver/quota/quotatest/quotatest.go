@@ -0,0 +1,216 @@
+// +build linux
+
+// Package quotatest provides fixtures for exercising project-quota-backed
+// storage drivers and other quota consumers (e.g. volume/local) against a
+// real, mounted xfs or ext4 filesystem, without each caller having to duplicate
+// the mkfs/mount/cleanup boilerplate.
+package quotatest
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"runtime"
+	"testing"
+
+	"github.com/docker/docker/daemon/graphdriver/quota"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+// minImageSize is the smallest sparse image mkfs.xfs will accept. Newer
+// xfsprogs releases reject anything smaller than this.
+const minImageSize = 300 * 1024 * 1024
+
+// minExt4ImageSize is the smallest sparse image mkfs.ext4 will format
+// without complaint; ext4 has no requirement anywhere near xfs's.
+const minExt4ImageSize = 64 * 1024 * 1024
+
+// CanTestQuota reports whether xfs project quota tests can run in the
+// current environment. If they can't, it returns a human-readable reason
+// that callers should pass to t.Skip.
+func CanTestQuota() (string, bool) {
+	return canTestQuota("mkfs.xfs")
+}
+
+// CanTestExt4Quota reports whether ext4 project quota tests can run in
+// the current environment. If they can't, it returns a human-readable
+// reason that callers should pass to t.Skip.
+func CanTestExt4Quota() (string, bool) {
+	return canTestQuota("mkfs.ext4")
+}
+
+func canTestQuota(mkfsCmd string) (string, bool) {
+	if os.Getuid() != 0 {
+		return "requires root", false
+	}
+	if _, err := exec.LookPath(mkfsCmd); err != nil {
+		return mkfsCmd + " not installed", false
+	}
+	return "", true
+}
+
+// PrepareQuotaTestImage creates a sparse xfs-formatted image file suitable
+// for project-quota testing and returns its path. The caller owns the file
+// and is responsible for removing it.
+func PrepareQuotaTestImage(t *testing.T) (string, error) {
+	imageFile, err := ioutil.TempFile("", "xfs-image")
+	if err != nil {
+		return "", err
+	}
+	imageFileName := imageFile.Name()
+
+	if _, err := imageFile.Seek(minImageSize-1, 0); err != nil {
+		os.Remove(imageFileName)
+		return "", err
+	}
+	if _, err := imageFile.Write([]byte{0}); err != nil {
+		os.Remove(imageFileName)
+		return "", err
+	}
+	if err := imageFile.Close(); err != nil {
+		os.Remove(imageFileName)
+		return "", err
+	}
+
+	mkfs, err := exec.LookPath("mkfs.xfs")
+	if err != nil {
+		os.Remove(imageFileName)
+		return "", err
+	}
+
+	// The reason for disabling these options is sometimes people run with a newer userspace
+	// than kernelspace
+	out, err := exec.Command(mkfs, "-m", "crc=0,finobt=0", imageFileName).CombinedOutput()
+	if len(out) > 0 {
+		t.Log(string(out))
+	}
+	if err != nil {
+		os.Remove(imageFileName)
+		return "", err
+	}
+
+	return imageFileName, nil
+}
+
+// PrepareExt4QuotaTestImage creates a sparse ext4-formatted image file
+// with the project quota feature enabled, suitable for project-quota
+// testing, and returns its path. The caller owns the file and is
+// responsible for removing it.
+func PrepareExt4QuotaTestImage(t *testing.T) (string, error) {
+	imageFile, err := ioutil.TempFile("", "ext4-image")
+	if err != nil {
+		return "", err
+	}
+	imageFileName := imageFile.Name()
+
+	if _, err := imageFile.Seek(minExt4ImageSize-1, 0); err != nil {
+		os.Remove(imageFileName)
+		return "", err
+	}
+	if _, err := imageFile.Write([]byte{0}); err != nil {
+		os.Remove(imageFileName)
+		return "", err
+	}
+	if err := imageFile.Close(); err != nil {
+		os.Remove(imageFileName)
+		return "", err
+	}
+
+	mkfs, err := exec.LookPath("mkfs.ext4")
+	if err != nil {
+		os.Remove(imageFileName)
+		return "", err
+	}
+
+	// quota,project enables the on-disk project quota feature; without it
+	// the "prjquota" mount option used by MountTest would be rejected.
+	out, err := exec.Command(mkfs, "-O", "quota,project", imageFileName).CombinedOutput()
+	if len(out) > 0 {
+		t.Log(string(out))
+	}
+	if err != nil {
+		os.Remove(imageFileName)
+		return "", err
+	}
+
+	return imageFileName, nil
+}
+
+// MountTest mounts the xfs or ext4 image at imageFileName, enabling prjquota when
+// enableQuota is set, then runs testFunc with the resulting mount point and
+// backing filesystem device before tearing the mount down again.
+func MountTest(t *testing.T, imageFileName string, enableQuota bool, testFunc func(t *testing.T, mountPoint, backingFsDev string)) {
+	mountOptions := "loop"
+	if enableQuota {
+		mountOptions = mountOptions + ",prjquota"
+	}
+
+	mountPoint, err := ioutil.TempDir("", "xfs-mountPoint")
+	require.NoError(t, err)
+	defer os.RemoveAll(mountPoint)
+
+	out, err := exec.Command("mount", "-o", mountOptions, imageFileName, mountPoint).CombinedOutput()
+	if len(out) > 0 {
+		t.Log(string(out))
+	}
+	require.NoError(t, err, "mount failed")
+
+	defer func() {
+		require.NoError(t, unix.Unmount(mountPoint, 0))
+	}()
+
+	backingFsDev, err := quota.MakeBackingFsDev(mountPoint)
+	require.NoError(t, err)
+
+	testFunc(t, mountPoint, backingFsDev)
+}
+
+// DropCapSysResource drops CAP_SYS_RESOURCE from the calling goroutine's
+// OS thread, for as long as that thread lives. On ext4, a process
+// holding CAP_SYS_RESOURCE is allowed to write past its project quota,
+// which would otherwise mask a broken enforcement path.
+//
+// Capabilities are per-OS-thread, and the Go runtime is free to move a
+// goroutine between threads at any scheduling point, so this locks the
+// calling goroutine to its current thread first. It deliberately never
+// unlocks: once this thread's capabilities have diverged from the rest of
+// the pool, it must not be handed back to run unrelated goroutines. The
+// runtime terminates the thread when this goroutine exits instead.
+func DropCapSysResource() error {
+	runtime.LockOSThread()
+
+	var hdr unix.CapUserHeader
+	var data [2]unix.CapUserData
+
+	hdr.Version = unix.LINUX_CAPABILITY_VERSION_3
+	if err := unix.Capget(&hdr, &data[0]); err != nil {
+		return err
+	}
+
+	const capSysResource = uint(unix.CAP_SYS_RESOURCE)
+	mask := ^uint32(1 << (capSysResource % 32))
+	if capSysResource < 32 {
+		data[0].Effective &= mask
+		data[0].Permitted &= mask
+	} else {
+		data[1].Effective &= mask
+		data[1].Permitted &= mask
+	}
+
+	return unix.Capset(&hdr, &data[0])
+}
+
+// WithMountedImage prepares a fresh xfs test image with prjquota enabled,
+// mounts it, and invokes testFunc with the resulting mount point and
+// backing filesystem device. The image and mount are cleaned up
+// automatically. It lets other subsystems (e.g. volume/local) write their
+// own quota-backed integration tests without duplicating this fixture
+// logic.
+func WithMountedImage(t *testing.T, testFunc func(t *testing.T, mountPoint, backingFsDev string)) {
+	imageFileName, err := PrepareQuotaTestImage(t)
+	require.NoError(t, err)
+	defer os.Remove(imageFileName)
+
+	MountTest(t, imageFileName, true, testFunc)
+}
@@ -0,0 +1,17 @@
+// Copyright 2012 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build darwin
+
+package tar
+
+// major and minor decode darwin's dev_t encoding: an 8-bit major in the
+// high byte of a 32-bit value, and a 24-bit minor below it.
+func major(dev uint64) uint32 {
+	return uint32((dev >> 24) & 0xff)
+}
+
+func minor(dev uint64) uint32 {
+	return uint32(dev & 0xffffff)
+}
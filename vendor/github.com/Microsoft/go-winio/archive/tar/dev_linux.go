@@ -0,0 +1,19 @@
+// Copyright 2012 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build linux
+
+package tar
+
+// major and minor decode Linux's dev_t encoding, per gnu_dev_major and
+// gnu_dev_minor in glibc's sysmacros.h: the low 8 bits of the minor in
+// bits 0-7, the low 12 bits of the major in bits 8-19, the rest of the
+// minor in bits 20-43 and the rest of the major in bits 44-63.
+func major(dev uint64) uint32 {
+	return uint32(((dev >> 8) & 0xfff) | ((dev >> 32) & 0xfffff000))
+}
+
+func minor(dev uint64) uint32 {
+	return uint32((dev & 0xff) | ((dev >> 12) & 0xffffff00))
+}
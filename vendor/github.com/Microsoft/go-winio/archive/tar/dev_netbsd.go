@@ -0,0 +1,18 @@
+// Copyright 2012 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build netbsd
+
+package tar
+
+// major and minor decode netbsd's dev_t encoding: a 12-bit major starting
+// at bit 8, and a minor made up of the low 8 bits plus a further 12 bits
+// starting at bit 20.
+func major(dev uint64) uint32 {
+	return uint32((dev & 0x000fff00) >> 8)
+}
+
+func minor(dev uint64) uint32 {
+	return uint32((dev & 0x000000ff) | ((dev & 0xfff00000) >> 12))
+}
@@ -0,0 +1,18 @@
+// Copyright 2012 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build openbsd
+
+package tar
+
+// major and minor decode openbsd's dev_t encoding: an 8-bit major
+// starting at bit 8, and a minor made up of the low 8 bits plus a
+// further 16 bits starting at bit 16.
+func major(dev uint64) uint32 {
+	return uint32((dev & 0x0000ff00) >> 8)
+}
+
+func minor(dev uint64) uint32 {
+	return uint32((dev & 0x000000ff) | ((dev & 0xffff0000) >> 8))
+}
@@ -0,0 +1,100 @@
+// Copyright 2012 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build linux darwin dragonfly freebsd openbsd netbsd
+
+// LOCAL PATCH (see /vendor.conf): this file (the uid/gid name cache used
+// by stat_unix.go) was added on top of whatever upstream revision this
+// package was vendored at. Carry it forward on the next vendor re-sync.
+package tar
+
+import (
+	"os/user"
+	"strconv"
+	"sync"
+)
+
+// DisableUserLookup disables uid/gid to name resolution when populating a
+// Header's Uname/Gname fields. Builds that can't afford cgo NSS calls (or
+// don't want them) can set this so that lookupUserName/lookupGroupName
+// return "" without doing any user or group lookup.
+var DisableUserLookup = false
+
+// idCacheLimit bounds how many uid/gid -> name entries we keep around per
+// cache. Layers can contain many thousands of distinct ids, so this is a
+// plain FIFO eviction rather than anything more elaborate.
+const idCacheLimit = 4096
+
+// idCache resolves ids to names, caching both hits and misses (a "negative
+// cache" entry) so that a layer with many files owned by an unknown id
+// doesn't repeatedly hit NSS for the same lookup.
+type idCache struct {
+	mu    sync.Mutex
+	names map[string]string
+	order []string
+}
+
+func (c *idCache) get(id string, resolve func(string) (string, error)) string {
+	c.mu.Lock()
+	name, ok := c.names[id]
+	c.mu.Unlock()
+	if ok {
+		return name
+	}
+
+	// Best-effort: on failure we still cache the empty string, so the
+	// negative result is remembered too.
+	name, _ = resolve(id)
+
+	c.mu.Lock()
+	if c.names == nil {
+		c.names = make(map[string]string)
+	}
+	if _, ok := c.names[id]; !ok {
+		if len(c.order) >= idCacheLimit {
+			delete(c.names, c.order[0])
+			c.order = c.order[1:]
+		}
+		c.order = append(c.order, id)
+	}
+	c.names[id] = name
+	c.mu.Unlock()
+
+	return name
+}
+
+var (
+	userNameCache  idCache
+	groupNameCache idCache
+)
+
+// lookupUserName returns the username for uid, or "" if it can't be
+// resolved or DisableUserLookup is set.
+func lookupUserName(uid int) string {
+	if DisableUserLookup {
+		return ""
+	}
+	return userNameCache.get(strconv.Itoa(uid), func(id string) (string, error) {
+		u, err := user.LookupId(id)
+		if err != nil {
+			return "", err
+		}
+		return u.Username, nil
+	})
+}
+
+// lookupGroupName returns the group name for gid, or "" if it can't be
+// resolved or DisableUserLookup is set.
+func lookupGroupName(gid int) string {
+	if DisableUserLookup {
+		return ""
+	}
+	return groupNameCache.get(strconv.Itoa(gid), func(id string) (string, error) {
+		g, err := user.LookupGroupId(id)
+		if err != nil {
+			return "", err
+		}
+		return g.Name, nil
+	})
+}
@@ -2,8 +2,15 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-// +build linux darwin dragonfly freebsd openbsd netbsd solaris
+// +build linux darwin dragonfly freebsd openbsd netbsd
 
+// LOCAL PATCH (see /vendor.conf): statUnix below now resolves Uname/Gname
+// via lookup.go and decodes device major/minor via the per-GOOS
+// dev_*.go files, on top of whatever upstream revision this package was
+// vendored at. solaris was dropped from the build tag: its dev_t
+// encoding isn't a fixed shift/mask pair the way the others are, so
+// there's no per-GOOS dev_solaris.go here yet. Carry this forward on the
+// next vendor re-sync.
 package tar
 
 import (
@@ -22,11 +29,14 @@ func statUnix(fi os.FileInfo, h *Header) error {
 	}
 	h.Uid = int(sys.Uid)
 	h.Gid = int(sys.Gid)
-	// TODO (bradfitz): populate username & group.  os/user id:880 gh:881
-	// doesn't cache LookupId lookups, and lacks group
-	// lookup functions.
+	h.Uname = lookupUserName(h.Uid)
+	h.Gname = lookupGroupName(h.Gid)
 	h.AccessTime = statAtime(sys)
 	h.ChangeTime = statCtime(sys)
-	// TODO (bradfitz): major/minor device numbers? id:330 gh:331
+	if h.Typeflag == TypeChar || h.Typeflag == TypeBlock {
+		dev := uint64(sys.Rdev)
+		h.Devmajor = int64(major(dev))
+		h.Devminor = int64(minor(dev))
+	}
 	return nil
 }
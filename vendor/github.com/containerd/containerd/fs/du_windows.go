@@ -1,25 +1,77 @@
 // +build windows
 
+// LOCAL PATCH (see /vendor.conf): diskUsage/diffUsage below dedup
+// hardlinked files by file id before summing size, on top of whatever
+// upstream revision this package was vendored at. Carry this change
+// forward on the next vendor re-sync.
 package fs
 
 import (
 	"context"
 	"os"
 	"path/filepath"
+
+	"golang.org/x/sys/windows"
 )
 
+// fileID uniquely identifies a file on a given volume, mirroring the
+// (device, inode) pair used to dedup hardlinks on Linux.
+type fileID struct {
+	volumeSerialNumber uint32
+	fileIndex          uint64
+}
+
+// getFileID opens path and reads back its per-volume file index, so that
+// hardlinked files can be counted only once.
+func getFileID(path string) (fileID, error) {
+	h, err := windows.CreateFile(
+		windows.StringToUTF16Ptr(path),
+		0,
+		windows.FILE_SHARE_READ|windows.FILE_SHARE_WRITE|windows.FILE_SHARE_DELETE,
+		nil,
+		windows.OPEN_EXISTING,
+		windows.FILE_FLAG_BACKUP_SEMANTICS,
+		0,
+	)
+	if err != nil {
+		return fileID{}, err
+	}
+	defer windows.CloseHandle(h)
+
+	var info windows.ByHandleFileInformation
+	if err := windows.GetFileInformationByHandle(h, &info); err != nil {
+		return fileID{}, err
+	}
+
+	return fileID{
+		volumeSerialNumber: info.VolumeSerialNumber,
+		fileIndex:          uint64(info.FileIndexHigh)<<32 | uint64(info.FileIndexLow),
+	}, nil
+}
+
 func diskUsage(roots ...string) (Usage, error) {
 	var (
 		size int64
+		seen = map[fileID]struct{}{}
 	)
 
-	// TODO (stevvooe): Support inodes (or equivalent) for windows. id:377 gh:378
-
 	for _, root := range roots {
 		if err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
 			if err != nil {
 				return err
 			}
+			if fi.IsDir() {
+				return nil
+			}
+
+			id, err := getFileID(path)
+			if err != nil {
+				return err
+			}
+			if _, ok := seen[id]; ok {
+				return nil
+			}
+			seen[id] = struct{}{}
 
 			size += fi.Size()
 			return nil
@@ -29,21 +81,36 @@ func diskUsage(roots ...string) (Usage, error) {
 	}
 
 	return Usage{
-		Size: size,
+		Size:   size,
+		Inodes: int64(len(seen)),
 	}, nil
 }
 
 func diffUsage(ctx context.Context, a, b string) (Usage, error) {
 	var (
 		size int64
+		seen = map[fileID]struct{}{}
 	)
 
-	if err := Changes(ctx, a, b, func(kind ChangeKind, _ string, fi os.FileInfo, err error) error {
+	if err := Changes(ctx, a, b, func(kind ChangeKind, path string, fi os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
 
 		if kind == ChangeKindAdd || kind == ChangeKindModify {
+			if fi.IsDir() {
+				return nil
+			}
+
+			id, err := getFileID(filepath.Join(b, path))
+			if err != nil {
+				return err
+			}
+			if _, ok := seen[id]; ok {
+				return nil
+			}
+			seen[id] = struct{}{}
+
 			size += fi.Size()
 
 			return nil
@@ -55,6 +122,7 @@ func diffUsage(ctx context.Context, a, b string) (Usage, error) {
 	}
 
 	return Usage{
-		Size: size,
+		Size:   size,
+		Inodes: int64(len(seen)),
 	}, nil
 }
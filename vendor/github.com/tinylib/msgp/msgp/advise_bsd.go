@@ -0,0 +1,30 @@
+// +build freebsd netbsd openbsd dragonfly
+// +build !appengine
+
+// LOCAL PATCH (see /vendor.conf): this file (adviseRead/adviseWrite) was
+// added on top of whatever upstream revision this package was vendored
+// at, along with fallocate_freebsd.go and fallocate_other_bsd.go. Carry
+// them forward on the next vendor re-sync.
+package msgp
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// madvise calls madvise(2) directly via raw syscall, since the "syscall"
+// package only wraps it for linux.
+func madvise(mem []byte, advice int) {
+	if len(mem) == 0 {
+		return
+	}
+	syscall.Syscall(syscall.SYS_MADVISE, uintptr(unsafe.Pointer(&mem[0])), uintptr(len(mem)), uintptr(advice))
+}
+
+func adviseRead(mem []byte) {
+	madvise(mem, syscall.MADV_SEQUENTIAL|syscall.MADV_WILLNEED)
+}
+
+func adviseWrite(mem []byte) {
+	madvise(mem, syscall.MADV_SEQUENTIAL)
+}
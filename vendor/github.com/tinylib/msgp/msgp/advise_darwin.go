@@ -0,0 +1,53 @@
+// +build darwin,!appengine
+
+// LOCAL PATCH (see /vendor.conf): this file (adviseRead/adviseWrite) was
+// added on top of whatever upstream revision this package was vendored
+// at. Carry it forward on the next vendor re-sync.
+package msgp
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// madvise calls madvise(2) directly via raw syscall, since the "syscall"
+// package only wraps it for linux.
+func madvise(mem []byte, advice int) {
+	if len(mem) == 0 {
+		return
+	}
+	syscall.Syscall(syscall.SYS_MADVISE, uintptr(unsafe.Pointer(&mem[0])), uintptr(len(mem)), uintptr(advice))
+}
+
+func adviseRead(mem []byte) {
+	madvise(mem, syscall.MADV_SEQUENTIAL|syscall.MADV_WILLNEED)
+}
+
+func adviseWrite(mem []byte) {
+	madvise(mem, syscall.MADV_SEQUENTIAL)
+}
+
+// fallocate pre-allocates sz bytes for f using F_PREALLOCATE, since darwin
+// has no posix_fallocate. It asks for a contiguous extent first, since
+// that's fastest for the sequential access streamed decoding relies on,
+// and falls back to an allocation that may be fragmented if the
+// filesystem can't satisfy that. Either way, ftruncate still has to run
+// afterwards to set the file's logical size.
+func fallocate(f *os.File, sz int64) error {
+	fstore := &syscall.Fstore_t{
+		Flags:   syscall.F_ALLOCATECONTIG,
+		Posmode: syscall.F_PEOFPOSMODE,
+		Length:  sz,
+	}
+	fd := f.Fd()
+	_, _, errno := syscall.Syscall(syscall.SYS_FCNTL, fd, syscall.F_PREALLOCATE, uintptr(unsafe.Pointer(fstore)))
+	if errno != 0 {
+		fstore.Flags = syscall.F_ALLOCATEALL
+		_, _, errno = syscall.Syscall(syscall.SYS_FCNTL, fd, syscall.F_PREALLOCATE, uintptr(unsafe.Pointer(fstore)))
+		if errno != 0 {
+			return f.Truncate(sz)
+		}
+	}
+	return f.Truncate(sz)
+}
@@ -1,13 +1,15 @@
-// +build !linux appengine
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly appengine
 
+// LOCAL PATCH (see /vendor.conf): the build tag above was narrowed to
+// make room for the darwin/bsd-specific implementations in
+// advise_darwin.go and advise_bsd.go. Carry this forward on the next
+// vendor re-sync.
 package msgp
 
 import (
 	"os"
 )
 
-// TODO: darwin, BSD support id:962 gh:963
-
 func adviseRead(mem []byte) {}
 
 func adviseWrite(mem []byte) {}
@@ -0,0 +1,31 @@
+// +build freebsd
+// +build !appengine
+
+// LOCAL PATCH (see /vendor.conf): this file was added on top of whatever
+// upstream revision this package was vendored at. Carry it forward on
+// the next vendor re-sync.
+package msgp
+
+import (
+	"os"
+	"syscall"
+)
+
+// fallocate pre-allocates sz bytes for f via a raw posix_fallocate(2)
+// syscall; freebsd is the only BSD that exposes SYS_POSIX_FALLOCATE.
+// Falls back to Truncate on filesystems that don't implement it (e.g.
+// tmpfs).
+func fallocate(f *os.File, sz int64) error {
+	r1, _, errno := syscall.Syscall(syscall.SYS_POSIX_FALLOCATE, f.Fd(), 0, uintptr(sz))
+	// posix_fallocate reports its error as the return value, not via errno.
+	if errno == 0 {
+		errno = syscall.Errno(r1)
+	}
+	if errno == syscall.EOPNOTSUPP || errno == syscall.ENOSYS {
+		return f.Truncate(sz)
+	}
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,18 @@
+// +build netbsd openbsd dragonfly
+// +build !appengine
+
+// LOCAL PATCH (see /vendor.conf): this file was added on top of whatever
+// upstream revision this package was vendored at. Carry it forward on
+// the next vendor re-sync.
+package msgp
+
+import "os"
+
+// fallocate pre-allocates sz bytes for f. None of netbsd, openbsd or
+// dragonfly expose posix_fallocate as a raw syscall (unlike freebsd, see
+// fallocate_freebsd.go), so this just sets the file's logical size
+// directly, the same as the freebsd path's fallback for filesystems that
+// don't support real preallocation.
+func fallocate(f *os.File, sz int64) error {
+	return f.Truncate(sz)
+}